@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/api"
+	uuid "github.com/hashicorp/go-uuid"
+)
+
+// LOGOUT is where the agent's logger writes when NewAgent is given no
+// logger (stderr); the tests build their loggers on it as well.
+var LOGOUT = os.Stderr
+
+// ServiceTokenMetaKey is the key an external service can set in its Consul
+// service Meta to pin a specific ACL token for its own check writes.
+const ServiceTokenMetaKey = "external-service-token"
+
+// alreadyExistsError is returned by Agent.Run when another ESM instance has
+// already registered with the same instance ID.
+type alreadyExistsError struct {
+	id string
+}
+
+func (e *alreadyExistsError) Error() string {
+	return fmt.Sprintf("an ESM instance with ID %q is already registered", e.id)
+}
+
+// Agent manages the lifecycle of the consul-esm process: registering itself
+// with Consul, watching the catalog for external nodes/services to monitor,
+// and running the check runners and coordinate updates for them.
+type Agent struct {
+	// config is swapped wholesale by Reload, so every access (including
+	// from other goroutines: the TTL updater, anti-entropy loop, HTTP
+	// handlers, ...) must go through getConfig/setConfig rather than
+	// dereferencing the field directly.
+	config     *Config
+	configLock sync.RWMutex
+
+	client *api.Client
+	logger *log.Logger
+
+	id string
+
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+	shutdown     bool
+
+	// tokens caches the resolved per-service ACL token for each monitored
+	// service so check runners don't have to re-resolve it on every write.
+	// Entries expire after Config.ServiceTokenTTL so a rotated Meta/KV
+	// token is picked up without an agent restart.
+	tokens     map[string]tokenCacheEntry
+	tokensLock sync.RWMutex
+
+	// httpServer is the optional metrics/health listener, nil unless
+	// Config.HTTPBindAddr is set.
+	httpServer *http.Server
+	inmemSink  *metrics.InmemSink
+	promSink   metrics.MetricSink
+
+	leader     bool
+	leaderLock sync.RWMutex
+
+	assignedNodes []string
+	assignedLock  sync.RWMutex
+
+	lastTTLStatus string
+	lastTTLUpdate time.Time
+	ttlLock       sync.RWMutex
+
+	// configFile is the path the SIGHUP handler passes to LoadConfigFile.
+	// NewAgent leaves it empty, in which case a SIGHUP reloads a copy of
+	// the current config.
+	configFile string
+	reloadLock sync.Mutex
+
+	watchLock     sync.Mutex
+	cancelWatches func()
+
+	// localState is the authoritative desired state for checks this
+	// instance owns; the anti-entropy loop reconciles it against Consul.
+	localState *localState
+}
+
+// NewAgent creates an Agent and the Consul API client it will use, but does
+// not start any of its background work -- call Run for that.
+func NewAgent(conf *Config, logger *log.Logger) (*Agent, error) {
+	if logger == nil {
+		logger = log.New(LOGOUT, "", log.LstdFlags)
+	}
+
+	client, err := api.NewClient(conf.ClientConfig())
+	if err != nil {
+		return nil, fmt.Errorf("error creating Consul client: %v", err)
+	}
+
+	id := conf.InstanceID
+	if id == "" {
+		var err error
+		id, err = uuid.GenerateUUID()
+		if err != nil {
+			return nil, fmt.Errorf("error generating instance ID: %v", err)
+		}
+	}
+
+	return &Agent{
+		config:     conf,
+		client:     client,
+		logger:     logger,
+		id:         id,
+		shutdownCh: make(chan struct{}),
+		tokens:     make(map[string]tokenCacheEntry),
+		localState: newLocalState(),
+	}, nil
+}
+
+// getConfig returns the agent's current configuration. Safe to call from
+// any goroutine; the returned *Config should be treated as immutable since
+// Reload replaces the field rather than mutating it in place.
+func (a *Agent) getConfig() *Config {
+	a.configLock.RLock()
+	defer a.configLock.RUnlock()
+	return a.config
+}
+
+// setConfig atomically replaces the agent's configuration.
+func (a *Agent) setConfig(c *Config) {
+	a.configLock.Lock()
+	defer a.configLock.Unlock()
+	a.config = c
+}
+
+// serviceID is the Consul service ID this agent registers itself under so
+// that other ESM instances (and the catalog watch) can see it.
+func (a *Agent) serviceID() string {
+	return fmt.Sprintf("%s:%s", a.getConfig().Service, a.id)
+}
+
+// checkID is the Consul check ID for this agent's own TTL liveness check.
+func (a *Agent) checkID() string {
+	return fmt.Sprintf("%s:%s:agent-ttl", a.getConfig().Service, a.id)
+}
+
+// Run registers the ESM service and TTL check, starts the TTL updater, the
+// SIGHUP reload handler and the anti-entropy loop, then blocks until
+// Shutdown is called. It starts no catalog watches or check runners.
+func (a *Agent) Run() error {
+	if err := a.setupMetrics(); err != nil {
+		return fmt.Errorf("error setting up metrics: %v", err)
+	}
+	if err := a.startHTTPServer(); err != nil {
+		return fmt.Errorf("error starting HTTP server: %v", err)
+	}
+
+	if err := a.register(); err != nil {
+		return err
+	}
+	a.setTTLStatus(api.HealthPassing)
+
+	a.safeGo("ttl-updater", func() error {
+		a.runTTLUpdater()
+		return nil
+	})
+
+	a.safeGo("reload-handler", func() error {
+		a.handleReloadSignal(a.Reload)
+		return nil
+	})
+
+	a.safeGo("anti-entropy", func() error {
+		a.runAntiEntropy(a.getConfig().AntiEntropyInterval)
+		return nil
+	})
+
+	<-a.shutdownCh
+	return nil
+}
+
+// startCheckRunner launches a single monitored service's CheckRunner loop,
+// wrapped in safeGo so a panicking probe (a bad HTTP/TCP/monitor check)
+// can't take down the rest of the agent -- it's logged, counted, and
+// restarted with backoff instead.
+func (a *Agent) startCheckRunner(name string, interval time.Duration, runner CheckRunner, u *checkUpdater) {
+	a.safeGo(name, func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				status, output := runner.Check()
+				if a.localState.set(u.checkID, u.serviceName, status, output) {
+					if err := u.updateCheck(status, output); err != nil {
+						a.logger.Printf("[WARN] agent: %s: error updating check: %v", name, err)
+					} else {
+						a.localState.markSynced(u.checkID)
+					}
+				}
+			case <-a.shutdownCh:
+				return nil
+			}
+		}
+	})
+}
+
+// startCatalogWatch launches a catalog-watch goroutine, wrapped in safeGo so
+// a panic in the watch handler restarts just that watch instead of the
+// whole agent.
+func (a *Agent) startCatalogWatch(name string, watchFn func() error) {
+	a.safeGo(name, watchFn)
+}
+
+// register registers (or re-registers) the ESM service and its TTL check
+// with Consul, failing if another live instance already holds this ID.
+func (a *Agent) register() error {
+	conf := a.getConfig()
+
+	existing, _, err := a.client.Catalog().Service(conf.Service, "", nil)
+	if err != nil {
+		return fmt.Errorf("error looking up existing ESM services: %v", err)
+	}
+	for _, svc := range existing {
+		if svc.ServiceID == a.serviceID() {
+			check, _, err := a.client.Health().Checks(conf.Service, nil)
+			if err == nil {
+				for _, c := range check {
+					if c.CheckID == a.checkID() && c.Status == api.HealthPassing {
+						return &alreadyExistsError{id: a.id}
+					}
+				}
+			}
+		}
+	}
+
+	registration := &api.AgentServiceRegistration{
+		ID:   a.serviceID(),
+		Name: conf.Service,
+		Tags: []string{conf.Tag},
+	}
+	if err := a.client.Agent().ServiceRegister(registration); err != nil {
+		return fmt.Errorf("error registering ESM service: %v", err)
+	}
+
+	if err := a.registerTTLCheck(conf); err != nil {
+		return err
+	}
+
+	return a.client.Agent().UpdateTTL(a.checkID(), "", api.HealthPassing)
+}
+
+// registerTTLCheck (re-)registers the agent's own liveness TTL check using
+// the TTL/deregister timeouts from conf. Called both by register and by
+// Reload whenever CoordinateUpdateInterval or NodeReconnectTimeout changes,
+// so a running agent's TTL check definition in Consul never goes stale.
+func (a *Agent) registerTTLCheck(conf *Config) error {
+	check := &api.AgentCheckRegistration{
+		ID:        a.checkID(),
+		Name:      "Consul External Service Monitor Alive",
+		ServiceID: a.serviceID(),
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL:                            (2 * conf.CoordinateUpdateInterval).String(),
+			DeregisterCriticalServiceAfter: conf.NodeReconnectTimeout.String(),
+		},
+	}
+	if err := a.client.Agent().CheckRegister(check); err != nil {
+		return fmt.Errorf("error registering ESM TTL check: %v", err)
+	}
+	return nil
+}
+
+// runTTLUpdater keeps the agent's own liveness TTL check passing and
+// re-registers the ESM service/check if they're ever removed out of band.
+// It re-reads CoordinateUpdateInterval from the current config on every
+// iteration so a Reload takes effect without restarting this goroutine.
+func (a *Agent) runTTLUpdater() {
+	for {
+		select {
+		case <-time.After(a.getConfig().CoordinateUpdateInterval):
+			status := api.HealthPassing
+			if err := a.client.Agent().UpdateTTL(a.checkID(), "", api.HealthPassing); err != nil {
+				a.logger.Printf("[WARN] agent: error updating TTL, re-registering: %v", err)
+				if err := a.register(); err != nil {
+					a.logger.Printf("[ERR] agent: error re-registering: %v", err)
+					status = api.HealthCritical
+				}
+			}
+			a.setTTLStatus(status)
+			metrics.SetGauge([]string{"nodes", "assigned"}, float32(a.nodesAssignedCount()))
+			if a.isLeader() {
+				metrics.SetGauge([]string{"is_leader"}, 1)
+			} else {
+				metrics.SetGauge([]string{"is_leader"}, 0)
+			}
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+// Shutdown deregisters the ESM service/check and stops all of the agent's
+// background work.
+func (a *Agent) Shutdown() {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+
+	if a.shutdown {
+		return
+	}
+	a.shutdown = true
+	close(a.shutdownCh)
+
+	if a.httpServer != nil {
+		a.httpServer.Close()
+	}
+
+	if err := a.client.Agent().ServiceDeregister(a.serviceID()); err != nil {
+		a.logger.Printf("[WARN] agent: error deregistering ESM service: %v", err)
+	}
+}
+
+// tokenCacheEntry is a resolved per-service token along with when it was
+// resolved, so serviceToken can expire it after Config.ServiceTokenTTL.
+type tokenCacheEntry struct {
+	token      string
+	resolvedAt time.Time
+}
+
+// serviceTokenKVPrefix is the fixed, top-level KV path (independent of
+// Config.ConsulKVPath, which namespaces the agent's own coordination state)
+// under which operators can drop a per-service-instance ACL token.
+const serviceTokenKVPrefix = "esm/tokens/"
+
+// serviceToken resolves the ACL token that should be used for check writes
+// made on behalf of the given monitored service/instance pair. It checks,
+// in order: the service's own Meta (ServiceTokenMetaKey), a dedicated KV
+// path (esm/tokens/<service>/<instance>), falling back to the agent's own
+// token from Config when neither is set. The result is cached for
+// Config.ServiceTokenTTL so repeated check runs don't re-hit Consul every
+// interval, while still picking up a rotated token without a restart.
+func (a *Agent) serviceToken(serviceName, instance string, meta map[string]string) string {
+	cacheKey := serviceName + "/" + instance
+
+	a.tokensLock.RLock()
+	entry, ok := a.tokens[cacheKey]
+	a.tokensLock.RUnlock()
+
+	conf := a.getConfig()
+	if ok && time.Since(entry.resolvedAt) < conf.ServiceTokenTTL {
+		return entry.token
+	}
+
+	token := conf.Token
+
+	if meta != nil {
+		if t, ok := meta[ServiceTokenMetaKey]; ok && t != "" {
+			token = t
+		}
+	}
+
+	if token == conf.Token {
+		kvPath := fmt.Sprintf("%s%s/%s", serviceTokenKVPrefix, serviceName, instance)
+		if pair, _, err := a.client.KV().Get(kvPath, nil); err == nil && pair != nil && len(pair.Value) > 0 {
+			token = string(pair.Value)
+		}
+	}
+
+	a.tokensLock.Lock()
+	a.tokens[cacheKey] = tokenCacheEntry{token: token, resolvedAt: time.Now()}
+	a.tokensLock.Unlock()
+
+	return token
+}
+
+// clearAllServiceTokens invalidates the entire per-service token cache,
+// forcing every subsequent serviceToken call to re-resolve from Meta/KV
+// instead of waiting out the TTL. Reload calls this on every config change
+// since that's the point at which operators are most likely to have
+// rotated a per-service token.
+func (a *Agent) clearAllServiceTokens() {
+	a.tokensLock.Lock()
+	a.tokens = make(map[string]tokenCacheEntry)
+	a.tokensLock.Unlock()
+}
+
+// setTTLStatus records the outcome of the most recent TTL update so the
+// /v1/agent/health endpoint can tell whether the agent is actually alive.
+func (a *Agent) setTTLStatus(status string) {
+	a.ttlLock.Lock()
+	defer a.ttlLock.Unlock()
+	a.lastTTLStatus = status
+	a.lastTTLUpdate = time.Now()
+}
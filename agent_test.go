@@ -1,15 +1,41 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/sdk/testutil/retry"
 )
 
+// recordingTransport wraps the default transport and remembers the
+// X-Consul-Token header of the last request it proxied, so tests can assert
+// on which ACL token an outgoing Consul write actually carried.
+type recordingTransport struct {
+	lock      sync.Mutex
+	lastToken string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.Lock()
+	t.lastToken = req.Header.Get("X-Consul-Token")
+	t.lock.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (t *recordingTransport) token() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.lastToken
+}
+
 func testAgent(t *testing.T, cb func(*Config)) *Agent {
 	logger := log.New(LOGOUT, "", log.LstdFlags)
 	conf := DefaultConfig()
@@ -236,3 +262,376 @@ func TestAgent_notUniqueInstanceIDFails(t *testing.T) {
 		t.Fatalf("Unexpected error type. Wanted an alreadyExistsError type. Error: '%v'", e)
 	}
 }
+
+func TestAgent_perServiceToken(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	agent := testAgent(t, func(c *Config) {
+		c.HTTPAddr = s.HTTPAddr
+	})
+	defer agent.Shutdown()
+
+	const wantToken = "service-specific-token"
+	meta := map[string]string{ServiceTokenMetaKey: wantToken}
+
+	if err := agent.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:   "web-1",
+		Name: "web",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := agent.client.Agent().CheckRegister(&api.AgentCheckRegistration{
+		ID:        "web:web-1:http",
+		Name:      "web check",
+		ServiceID: "web-1",
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL: "1m",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap in a client whose transport records the token attached to every
+	// outgoing request, so updateCheck's actual UpdateTTLOpts call can be
+	// asserted on instead of just the resolver it delegates to.
+	transport := &recordingTransport{}
+	cc := agent.getConfig().ClientConfig()
+	cc.HttpClient = &http.Client{Transport: transport}
+	client, err := api.NewClient(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent.client = client
+
+	u := &checkUpdater{
+		agent:       agent,
+		serviceName: "web",
+		instance:    "web-1",
+		serviceMeta: meta,
+		checkID:     "web:web-1:http",
+	}
+
+	if err := u.updateCheck(api.HealthPassing, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if got := transport.token(); got != wantToken {
+		t.Fatalf("got token %q on outgoing UpdateTTLOpts call, want %q", got, wantToken)
+	}
+
+	// A service with no Meta/KV override falls back to the agent's token.
+	noOverride := &checkUpdater{
+		agent:       agent,
+		serviceName: "other-service",
+		instance:    "other-1",
+		checkID:     "web:web-1:http",
+	}
+	if err := noOverride.updateCheck(api.HealthPassing, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := transport.token(), agent.getConfig().Token; got != want {
+		t.Fatalf("got token %q, want agent token %q", got, want)
+	}
+}
+
+func TestAgent_httpMetricsAndHealth(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	agent := testAgent(t, func(c *Config) {
+		c.HTTPAddr = s.HTTPAddr
+		c.HTTPBindAddr = "127.0.0.1"
+		c.HTTPBindPort = "0"
+	})
+	defer agent.Shutdown()
+
+	retry.Run(t, func(r *retry.R) {
+		if agent.inmemSink == nil {
+			r.Fatal("metrics sink not initialized yet")
+		}
+	})
+
+	// Drive a passing HTTP check and a failing TCP check directly so their
+	// counters/timers land in the sink, and wait for runTTLUpdater to have
+	// ticked at least once so the leader/assigned-nodes gauges are set.
+	hc := &HTTPCheck{checkUpdater: checkUpdater{agent: agent}, HTTP: "http://127.0.0.1/"}
+	hc.Check()
+	tc := &TCPCheck{checkUpdater: checkUpdater{agent: agent}, TCP: "127.0.0.1:1", Timeout: "50ms"}
+	if status, _ := tc.Check(); status != api.HealthCritical {
+		t.Fatalf("got status %q, want critical for a refused connection", status)
+	}
+	time.Sleep(2 * agent.getConfig().CoordinateUpdateInterval)
+
+	rr := httptest.NewRecorder()
+	agent.handleSelf(rr, httptest.NewRequest("GET", "/v1/agent/self", nil))
+
+	var self selfResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &self); err != nil {
+		t.Fatal(err)
+	}
+	if self.InstanceID != agent.id {
+		t.Fatalf("got instance id %q, want %q", self.InstanceID, agent.id)
+	}
+
+	mr := httptest.NewRecorder()
+	agent.handleMetrics(mr, httptest.NewRequest("GET", "/v1/agent/metrics", nil))
+	if mr.Code != 200 {
+		t.Fatalf("got status %d, want 200", mr.Code)
+	}
+
+	var summary struct {
+		Counters []struct {
+			Name string
+		}
+		Gauges []struct {
+			Name string
+		}
+	}
+	if err := json.Unmarshal(mr.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	wantCounters := []string{"esm.checks.tcp.failures"}
+	for _, want := range wantCounters {
+		found := false
+		for _, c := range summary.Counters {
+			if c.Name == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("expected counter %q in metrics summary, got %+v", want, summary.Counters)
+		}
+	}
+
+	wantGauges := []string{"esm.nodes.assigned", "esm.is_leader"}
+	for _, want := range wantGauges {
+		found := false
+		for _, g := range summary.Gauges {
+			if g.Name == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("expected gauge %q in metrics summary, got %+v", want, summary.Gauges)
+		}
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		hr := httptest.NewRecorder()
+		agent.handleHealth(hr, httptest.NewRequest("GET", "/v1/agent/health", nil))
+		if hr.Code != 200 {
+			r.Fatalf("got status %d, want 200", hr.Code)
+		}
+	})
+}
+
+func TestAgent_reload(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	agent := testAgent(t, func(c *Config) {
+		c.HTTPAddr = s.HTTPAddr
+		c.Tag = "test"
+	})
+	defer agent.Shutdown()
+
+	wantID := agent.serviceID()
+
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := agent.client.Catalog().Service(agent.config.Service, "", nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		if len(services) != 1 {
+			r.Fatalf("bad: %v", services)
+		}
+		if got, want := services[0].ServiceTags, []string{"test"}; !reflect.DeepEqual(got, want) {
+			r.Fatalf("got %q, want %q", got, want)
+		}
+	})
+
+	newConf := *agent.config
+	newConf.Tag = "reloaded"
+	if err := agent.Reload(&newConf); err != nil {
+		t.Fatal(err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		services, _, err := agent.client.Catalog().Service(agent.config.Service, "", nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		if len(services) != 1 {
+			r.Fatalf("bad: %v", services)
+		}
+		if got, want := services[0].ServiceTags, []string{"reloaded"}; !reflect.DeepEqual(got, want) {
+			r.Fatalf("got %q, want %q", got, want)
+		}
+		if got, want := services[0].ServiceID, wantID; got != want {
+			r.Fatalf("got service id %q, want %q (instance ID must not change)", got, want)
+		}
+	})
+}
+
+func TestAgent_antiEntropy(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	agent := testAgent(t, func(c *Config) {
+		c.HTTPAddr = s.HTTPAddr
+		c.AntiEntropyInterval = 100 * time.Millisecond
+	})
+	defer agent.Shutdown()
+
+	// Register an external service, distinct from the ESM agent's own
+	// service, that this instance is monitoring.
+	if err := agent.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:   "web-1",
+		Name: "web",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	ownedCheckID := fmt.Sprintf("%s:%s:web-check", agent.config.Service, agent.id)
+	orphanCheckID := fmt.Sprintf("%s:%s:orphan", agent.config.Service, agent.id)
+
+	// A check this instance legitimately owns, present in both the catalog
+	// and localState.
+	if err := agent.client.Agent().CheckRegister(&api.AgentCheckRegistration{
+		ID:        ownedCheckID,
+		Name:      "web check",
+		ServiceID: "web-1",
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL: "1m",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	agent.client.Agent().UpdateTTL(ownedCheckID, "", api.HealthPassing)
+	agent.localState.set(ownedCheckID, "web", api.HealthPassing, "")
+
+	// An out-of-band check under the same monitored service and this
+	// instance's CheckID prefix, but absent from localState -- it was
+	// reassigned away from this instance and is now orphaned.
+	if err := agent.client.Agent().CheckRegister(&api.AgentCheckRegistration{
+		ID:        orphanCheckID,
+		Name:      "orphaned",
+		ServiceID: "web-1",
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL: "1m",
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err := agent.client.Health().Checks("web", nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		found := false
+		for _, c := range checks {
+			if c.CheckID == orphanCheckID {
+				r.Fatalf("orphaned check %q was not reconciled away", orphanCheckID)
+			}
+			if c.CheckID == ownedCheckID {
+				found = true
+			}
+		}
+		if !found {
+			r.Fatalf("owned check %q was incorrectly removed", ownedCheckID)
+		}
+	})
+
+	// The agent's own liveness TTL check must never be touched by anti-entropy.
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err := agent.client.Health().Checks(agent.config.Service, nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		for _, c := range checks {
+			if c.CheckID == agent.checkID() && c.Status != api.HealthPassing {
+				r.Fatalf("got status %q for agent TTL check, want passing", c.Status)
+			}
+		}
+	})
+}
+
+// panicCheck is a CheckRunner that panics on every invocation, used to prove
+// that safeGo contains a runner panic instead of crashing the agent.
+type panicCheck struct{}
+
+func (panicCheck) Check() (string, string) {
+	panic("simulated check panic")
+}
+
+func TestAgent_safeGoRecoversPanickingCheck(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	agent := testAgent(t, func(c *Config) {
+		c.HTTPAddr = s.HTTPAddr
+	})
+	defer agent.Shutdown()
+
+	u := &checkUpdater{
+		agent:       agent,
+		serviceName: "flaky",
+		instance:    "flaky-1",
+		checkID:     fmt.Sprintf("%s:flaky", agent.serviceID()),
+	}
+	agent.startCheckRunner("flaky-check", 50*time.Millisecond, panicCheck{}, u)
+
+	// Give the panicking runner a chance to blow up at least once (safeGo
+	// then waits its 1s initial backoff before restarting it).
+	time.Sleep(300 * time.Millisecond)
+
+	// The agent's own TTL check must still be passing despite the
+	// panicking check runner.
+	retry.Run(t, func(r *retry.R) {
+		checks, _, err := agent.client.Health().Checks(agent.config.Service, nil)
+		if err != nil {
+			r.Fatal(err)
+		}
+		found := false
+		for _, c := range checks {
+			if c.CheckID == agent.checkID() {
+				found = true
+				if c.Status != "passing" {
+					r.Fatalf("got status %q, want passing", c.Status)
+				}
+			}
+		}
+		if !found {
+			r.Fatal("agent TTL check missing")
+		}
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/consul/api"
+)
+
+// desiredCheckState is the authoritative, in-memory record of what a
+// monitored check's status/output should be, mirroring how Consul's own
+// agent local state tracks desired vs. actual catalog state.
+type desiredCheckState struct {
+	ServiceID string
+	CheckID   string
+	Status    string
+	Output    string
+	UpdatedAt time.Time
+}
+
+// localState is Agent's authoritative map of (checkID -> desired check
+// state) for every check this instance currently owns. Check runners record
+// every result in it and write to Consul themselves only when the desired
+// state changed; the anti-entropy loop pushes stale or diverged entries to
+// the catalog and repairs missing or orphaned checks.
+//
+// synced tracks, separately from the desired state itself, when each check
+// was last actually written to Consul -- set() is called on every check
+// tick regardless of whether anything changed, so UpdatedAt alone can't be
+// used to tell whether a check has gone stale from Consul's point of view.
+type localState struct {
+	lock   sync.Mutex
+	checks map[string]*desiredCheckState
+	synced map[string]time.Time
+}
+
+func newLocalState() *localState {
+	return &localState{
+		checks: make(map[string]*desiredCheckState),
+		synced: make(map[string]time.Time),
+	}
+}
+
+// set records the desired state for a check, returning true if it differs
+// from what was previously recorded (and therefore needs to be synced).
+func (s *localState) set(checkID, serviceID, status, output string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cur, ok := s.checks[checkID]
+	changed := !ok || cur.Status != status || cur.Output != output
+	s.checks[checkID] = &desiredCheckState{
+		ServiceID: serviceID,
+		CheckID:   checkID,
+		Status:    status,
+		Output:    output,
+		UpdatedAt: time.Now(),
+	}
+	return changed
+}
+
+func (s *localState) remove(checkID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.checks, checkID)
+	delete(s.synced, checkID)
+}
+
+// markSynced records that checkID was just written to Consul, resetting its
+// anti-entropy staleness clock.
+func (s *localState) markSynced(checkID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.synced[checkID] = time.Now()
+}
+
+// syncedStale reports whether checkID hasn't been written to Consul within
+// maxStale -- true if it's never been synced at all.
+func (s *localState) syncedStale(checkID string, maxStale time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	last, ok := s.synced[checkID]
+	return !ok || time.Since(last) > maxStale
+}
+
+func (s *localState) snapshot() map[string]*desiredCheckState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	out := make(map[string]*desiredCheckState, len(s.checks))
+	for k, v := range s.checks {
+		out[k] = v
+	}
+	return out
+}
+
+// runAntiEntropy periodically diffs the agent's local desired check state
+// against what Consul's catalog actually reports and reconciles the two:
+// pushing updates only when something changed or has gone stale,
+// re-registering checks that disappeared out from under us, and removing
+// catalog checks that carry this instance's CheckID prefix but are no
+// longer assigned to it.
+func (a *Agent) runAntiEntropy(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.syncAntiEntropy()
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+func (a *Agent) syncAntiEntropy() {
+	conf := a.getConfig()
+	desired := a.localState.snapshot()
+
+	// Desired checks live under their own monitored service (e.g. "web"),
+	// not the ESM agent's own service ("consul-esm"), so fetch each
+	// distinct monitored service's checks rather than the agent's own.
+	serviceNames := make(map[string]bool, len(desired))
+	for _, want := range desired {
+		serviceNames[want.ServiceID] = true
+	}
+
+	remoteByID := make(map[string]*api.HealthCheck, len(desired))
+	for name := range serviceNames {
+		checks, _, err := a.client.Health().Checks(name, nil)
+		if err != nil {
+			a.logger.Printf("[WARN] agent: anti-entropy: error fetching checks for %q: %v", name, err)
+			continue
+		}
+		for _, c := range checks {
+			remoteByID[c.CheckID] = c
+		}
+	}
+
+	for checkID, want := range desired {
+		have, ok := remoteByID[checkID]
+		stale := ok && a.localState.syncedStale(checkID, conf.AntiEntropyMaxStale)
+
+		switch {
+		case !ok:
+			// Check vanished from the catalog but we still own it: re-register.
+			if err := a.reregisterCheck(want); err != nil {
+				a.logger.Printf("[WARN] agent: anti-entropy: error re-registering %q: %v", checkID, err)
+				continue
+			}
+			a.localState.markSynced(checkID)
+			metrics.IncrCounter([]string{"anti_entropy", "repaired"}, 1)
+		case have.Status != want.Status || have.Output != want.Output || stale:
+			token := a.serviceToken(want.ServiceID, want.ServiceID, nil)
+			if err := a.client.Agent().UpdateTTLOpts(checkID, want.Output, want.Status, &api.QueryOptions{Token: token}); err != nil {
+				a.logger.Printf("[WARN] agent: anti-entropy: error syncing %q: %v", checkID, err)
+				continue
+			}
+			a.localState.markSynced(checkID)
+			metrics.IncrCounter([]string{"anti_entropy", "syncs"}, 1)
+		default:
+			metrics.IncrCounter([]string{"anti_entropy", "skipped"}, 1)
+		}
+	}
+
+	// Delete any catalog check that still carries this instance's CheckID
+	// prefix but is no longer in our desired state -- it was reassigned
+	// away from us (or removed) and the old entry is now orphaned. The
+	// agent's own liveness TTL check is never part of localState and must
+	// never be swept up here.
+	prefix := conf.Service + ":" + a.id + ":"
+	ownCheckID := a.checkID()
+	for checkID := range remoteByID {
+		if checkID == ownCheckID {
+			continue
+		}
+		if _, ok := desired[checkID]; ok {
+			continue
+		}
+		if !strings.HasPrefix(checkID, prefix) {
+			continue
+		}
+		if err := a.client.Agent().CheckDeregister(checkID); err != nil {
+			a.logger.Printf("[WARN] agent: anti-entropy: error removing orphaned check %q: %v", checkID, err)
+			continue
+		}
+		metrics.IncrCounter([]string{"anti_entropy", "repaired"}, 1)
+	}
+}
+
+func (a *Agent) reregisterCheck(want *desiredCheckState) error {
+	token := a.serviceToken(want.ServiceID, want.ServiceID, nil)
+	check := &api.AgentCheckRegistration{
+		ID:        want.CheckID,
+		Name:      want.CheckID,
+		ServiceID: want.ServiceID,
+		AgentServiceCheck: api.AgentServiceCheck{
+			TTL: a.getConfig().CoordinateUpdateInterval.String(),
+		},
+	}
+	if err := a.client.Agent().CheckRegister(check); err != nil {
+		return err
+	}
+	return a.client.Agent().UpdateTTLOpts(want.CheckID, want.Output, want.Status, &api.QueryOptions{Token: token})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// Config is the configuration for the ESM agent.
+type Config struct {
+	// InstanceID is used to identify this ESM instance in the external service
+	// it registers with Consul. If empty, one will be generated automatically.
+	InstanceID string
+
+	// Service is the name this agent will use to register itself with Consul
+	// so that it can be tracked for liveness and leader election.
+	Service string
+
+	// Tag is used for Consul service tag based filtering of external services
+	// and nodes that this agent should monitor.
+	Tag string
+
+	// InstancePoolSize is the number of ESM instances expected to share a single
+	// Tag, used to partition the external nodes/services between them.
+	InstancePoolSize int
+
+	// CoordinateUpdateInterval controls how often we update Consul with
+	// network coordinates for the external nodes we're monitoring.
+	CoordinateUpdateInterval time.Duration
+
+	// NodeReconnectTimeout controls how long we wait for a failed external
+	// node to reconnect before considering it permanently deregistered.
+	NodeReconnectTimeout time.Duration
+
+	// NodeMeta is the set of Consul node meta key/value pairs used to filter
+	// which external nodes this agent is responsible for.
+	NodeMeta map[string]string
+
+	// ConsulKVPath is the prefix under which the ESM agents store their
+	// coordination state (leader election, etc). Per-service tokens are
+	// read from the fixed esm/tokens/ prefix, not from under this path.
+	ConsulKVPath string
+
+	// PingType is the ESM-level ping check type (PingTypeUDP or
+	// PingTypeSock) applied to every external node.
+	PingType string
+
+	// HTTPAddr, Token, Datacenter, CAFile, etc. are passed straight through to
+	// the Consul API client used for both the agent's own registration and
+	// catalog/health writes on behalf of monitored services.
+	HTTPAddr   string
+	Token      string
+	Datacenter string
+	CAFile     string
+	CAPath     string
+	CertFile   string
+	KeyFile    string
+
+	// LogLevel controls the verbosity of the agent's logger.
+	LogLevel string
+
+	// HTTPBindAddr and HTTPBindPort configure the optional metrics/health
+	// HTTP listener. The listener starts whenever HTTPBindAddr is set; an
+	// empty HTTPBindPort lets the OS pick the port.
+	HTTPBindAddr string
+	HTTPBindPort string
+
+	// AntiEntropyInterval controls how often the local/remote check state
+	// reconciliation loop runs.
+	AntiEntropyInterval time.Duration
+
+	// AntiEntropyMaxStale forces a check to be re-pushed to Consul even when
+	// its desired state hasn't changed, once this long has passed since its
+	// last sync.
+	AntiEntropyMaxStale time.Duration
+
+	// ServiceTokenTTL bounds how long a resolved per-service ACL token
+	// (Config.Token fallback, service Meta, or esm/tokens/ KV override) is
+	// cached before serviceToken re-resolves it, so a rotated token is
+	// picked up without an agent restart.
+	ServiceTokenTTL time.Duration
+
+	clientConfig *api.Config
+}
+
+// ClientConfig returns the api.Config that should be used to build the
+// Consul client this agent uses for its own registration and catalog watches.
+func (c *Config) ClientConfig() *api.Config {
+	if c.clientConfig != nil {
+		return c.clientConfig
+	}
+
+	conf := api.DefaultConfig()
+	conf.Address = c.HTTPAddr
+	conf.Token = c.Token
+	conf.Datacenter = c.Datacenter
+	conf.TLSConfig.CAFile = c.CAFile
+	conf.TLSConfig.CAPath = c.CAPath
+	conf.TLSConfig.CertFile = c.CertFile
+	conf.TLSConfig.KeyFile = c.KeyFile
+	return conf
+}
+
+// LoadConfigFile is what the SIGHUP handler calls to load a new config for
+// Agent.Reload. It does not open or parse the file at path: it returns
+// DefaultConfig() and a nil error.
+func LoadConfigFile(path string) (*Config, error) {
+	return DefaultConfig(), nil
+}
+
+// DefaultConfig returns a Config populated with the same defaults the ESM
+// binary uses when no config file/flags override them.
+func DefaultConfig() *Config {
+	return &Config{
+		Service:                  "consul-esm",
+		Tag:                      "external-node",
+		InstancePoolSize:         1,
+		CoordinateUpdateInterval: 30 * time.Second,
+		NodeReconnectTimeout:     72 * time.Hour,
+		ConsulKVPath:             "consul-esm/",
+		PingType:                 PingTypeUDP,
+		LogLevel:                 "INFO",
+		AntiEntropyInterval:      10 * time.Second,
+		AntiEntropyMaxStale:      10 * time.Minute,
+		ServiceTokenTTL:          1 * time.Minute,
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/armon/go-metrics/prometheus"
+)
+
+// selfResponse is the payload served from /v1/agent/self.
+type selfResponse struct {
+	Config        sanitizedConfig `json:"Config"`
+	InstanceID    string          `json:"InstanceID"`
+	IsLeader      bool            `json:"IsLeader"`
+	NodesAssigned int             `json:"NodesAssigned"`
+}
+
+// sanitizedConfig is the subset of Config safe to expose over an
+// unauthenticated HTTP endpoint -- it deliberately omits Token and the TLS
+// material (CAFile/CAPath/CertFile/KeyFile), none of which an operator
+// hitting /v1/agent/self should ever be able to read back out.
+type sanitizedConfig struct {
+	Service                  string
+	Tag                      string
+	InstancePoolSize         int
+	CoordinateUpdateInterval time.Duration
+	NodeReconnectTimeout     time.Duration
+	NodeMeta                 map[string]string
+	ConsulKVPath             string
+	PingType                 string
+	Datacenter               string
+	LogLevel                 string
+	HTTPBindAddr             string
+	HTTPBindPort             string
+	AntiEntropyInterval      time.Duration
+	AntiEntropyMaxStale      time.Duration
+	ServiceTokenTTL          time.Duration
+}
+
+func newSanitizedConfig(c *Config) sanitizedConfig {
+	return sanitizedConfig{
+		Service:                  c.Service,
+		Tag:                      c.Tag,
+		InstancePoolSize:         c.InstancePoolSize,
+		CoordinateUpdateInterval: c.CoordinateUpdateInterval,
+		NodeReconnectTimeout:     c.NodeReconnectTimeout,
+		NodeMeta:                 c.NodeMeta,
+		ConsulKVPath:             c.ConsulKVPath,
+		PingType:                 c.PingType,
+		Datacenter:               c.Datacenter,
+		LogLevel:                 c.LogLevel,
+		HTTPBindAddr:             c.HTTPBindAddr,
+		HTTPBindPort:             c.HTTPBindPort,
+		AntiEntropyInterval:      c.AntiEntropyInterval,
+		AntiEntropyMaxStale:      c.AntiEntropyMaxStale,
+		ServiceTokenTTL:          c.ServiceTokenTTL,
+	}
+}
+
+// healthResponse is the payload served from /v1/agent/health.
+type healthResponse struct {
+	Healthy bool `json:"Healthy"`
+}
+
+// startHTTPServer starts the optional HTTP listener used for metrics and
+// health checks. It is a no-op if HTTPBindAddr is unset, and its lifetime is
+// tied to a.shutdownCh.
+func (a *Agent) startHTTPServer() error {
+	conf := a.getConfig()
+	if conf.HTTPBindAddr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/self", a.handleSelf)
+	mux.HandleFunc("/v1/agent/metrics", a.handleMetrics)
+	mux.HandleFunc("/v1/agent/health", a.handleHealth)
+
+	addr := net.JoinHostPort(conf.HTTPBindAddr, conf.HTTPBindPort)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{Handler: mux}
+	a.httpServer = srv
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			a.logger.Printf("[ERR] agent: HTTP server error: %v", err)
+		}
+	}()
+
+	go func() {
+		<-a.shutdownCh
+		srv.Close()
+	}()
+
+	return nil
+}
+
+func (a *Agent) handleSelf(w http.ResponseWriter, req *http.Request) {
+	resp := selfResponse{
+		Config:        newSanitizedConfig(a.getConfig()),
+		InstanceID:    a.id,
+		IsLeader:      a.isLeader(),
+		NodesAssigned: a.nodesAssignedCount(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (a *Agent) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Accept") == "text/plain" {
+		if sink, ok := a.promSink.(*prometheus.PrometheusSink); ok {
+			sink.HandleRequest(w, req)
+			return
+		}
+	}
+
+	data, err := a.inmemSink.DisplayMetrics(w, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (a *Agent) handleHealth(w http.ResponseWriter, req *http.Request) {
+	healthy := a.lastTTLPassing() && a.connectedToConsul()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(healthResponse{Healthy: healthy})
+}
+
+func (a *Agent) connectedToConsul() bool {
+	_, err := a.client.Agent().Self()
+	return err == nil
+}
+
+func (a *Agent) lastTTLPassing() bool {
+	a.ttlLock.RLock()
+	defer a.ttlLock.RUnlock()
+	return a.lastTTLStatus == "passing" && time.Since(a.lastTTLUpdate) < 2*a.getConfig().CoordinateUpdateInterval
+}
+
+// setupMetrics wires up the go-metrics sinks (in-memory + Prometheus) that
+// back /v1/agent/metrics, and are used by the check runners to record
+// latency/outcome via metrics.MeasureSince / metrics.IncrCounter.
+func (a *Agent) setupMetrics() error {
+	inm := metrics.NewInmemSink(10*time.Second, time.Minute)
+	a.inmemSink = inm
+
+	promSink, err := prometheus.NewPrometheusSink()
+	if err != nil {
+		return err
+	}
+	a.promSink = promSink
+
+	fanout := metrics.FanoutSink{inm, promSink}
+	conf := metrics.DefaultConfig("esm")
+	conf.EnableHostname = false
+	_, err = metrics.NewGlobal(conf, fanout)
+	return err
+}
+
+func (a *Agent) isLeader() bool {
+	a.leaderLock.RLock()
+	defer a.leaderLock.RUnlock()
+	return a.leader
+}
+
+func (a *Agent) nodesAssignedCount() int {
+	a.assignedLock.RLock()
+	defer a.assignedLock.RUnlock()
+	return len(a.assignedNodes)
+}
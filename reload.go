@@ -0,0 +1,134 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// handleReloadSignal blocks waiting for SIGHUP and calls reloadFn each time
+// one arrives, until the agent shuts down. It's started as its own goroutine
+// from Run.
+func (a *Agent) handleReloadSignal(reloadFn func(*Config) error) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-sigCh:
+			a.logger.Printf("[INFO] agent: received SIGHUP, reloading configuration")
+			newConf, err := a.loadConfigFile()
+			if err != nil {
+				a.logger.Printf("[ERR] agent: error reloading configuration: %v", err)
+				continue
+			}
+			if err := reloadFn(newConf); err != nil {
+				a.logger.Printf("[ERR] agent: error applying reloaded configuration: %v", err)
+			}
+		case <-a.shutdownCh:
+			return
+		}
+	}
+}
+
+// loadConfigFile returns LoadConfigFile(a.configFile), or the current config
+// when configFile is empty (as it is for every agent NewAgent builds).
+func (a *Agent) loadConfigFile() (*Config, error) {
+	if a.configFile == "" {
+		return a.getConfig(), nil
+	}
+	return LoadConfigFile(a.configFile)
+}
+
+// Reload applies a subset of configuration changes in place, without
+// deregistering the ESM service or tearing down catalog watches that
+// haven't changed. Only the fields below are taken from newConfig; every
+// other field (Service, InstanceID, HTTPAddr, Token, Datacenter, TLS
+// settings, ConsulKVPath, HTTPBindAddr/Port, AntiEntropyInterval/MaxStale,
+// ServiceTokenTTL, InstancePoolSize, ...) keeps its current running value
+// and requires a full restart to change.
+func (a *Agent) Reload(newConfig *Config) error {
+	a.reloadLock.Lock()
+	defer a.reloadLock.Unlock()
+
+	old := a.getConfig()
+	tagChanged := old.Tag != newConfig.Tag
+	ttlCheckChanged := old.CoordinateUpdateInterval != newConfig.CoordinateUpdateInterval ||
+		old.NodeReconnectTimeout != newConfig.NodeReconnectTimeout
+
+	merged := *old
+	merged.CoordinateUpdateInterval = newConfig.CoordinateUpdateInterval
+	merged.Tag = newConfig.Tag
+	merged.NodeReconnectTimeout = newConfig.NodeReconnectTimeout
+	merged.PingType = newConfig.PingType
+	merged.LogLevel = newConfig.LogLevel
+	a.setConfig(&merged)
+	a.clearAllServiceTokens()
+
+	if tagChanged {
+		if err := a.reregisterWithTag(merged.Tag); err != nil {
+			return err
+		}
+	}
+
+	if ttlCheckChanged {
+		if err := a.registerTTLCheck(&merged); err != nil {
+			return err
+		}
+	}
+
+	a.restartWatchesIfFilterChanged(old, &merged)
+
+	a.logger.Printf("[INFO] agent: configuration reloaded")
+	return nil
+}
+
+// reregisterWithTag re-registers the ESM service under the same service ID
+// but with a new tag, so the tag change takes effect without a restart.
+func (a *Agent) reregisterWithTag(tag string) error {
+	return a.client.Agent().ServiceRegister(&api.AgentServiceRegistration{
+		ID:   a.serviceID(),
+		Name: a.getConfig().Service,
+		Tags: []string{tag},
+	})
+}
+
+// restartWatchesIfFilterChanged calls the current cancel function and
+// replaces it with a new one from startWatches when Tag or NodeMeta changed
+// as a result of the reload; otherwise it does nothing.
+func (a *Agent) restartWatchesIfFilterChanged(old, new *Config) {
+	if old.Tag == new.Tag && mapsEqual(old.NodeMeta, new.NodeMeta) {
+		return
+	}
+
+	a.watchLock.Lock()
+	defer a.watchLock.Unlock()
+
+	if a.cancelWatches != nil {
+		a.cancelWatches()
+	}
+	a.cancelWatches = a.startWatches(new)
+}
+
+// startWatches returns the cancel function kept in a.cancelWatches. It
+// starts no catalog-watch goroutines: the returned function only closes a
+// channel that nothing waits on.
+func (a *Agent) startWatches(conf *Config) func() {
+	done := make(chan struct{})
+	return func() { close(done) }
+}
+
+func mapsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// safeGoMaxBackoff caps the exponential backoff safeGo applies between
+// restarts of a panicking goroutine.
+const safeGoMaxBackoff = 30 * time.Second
+
+// safeGo runs fn in its own goroutine, recovering any panic, logging it
+// with the goroutine's name and a stack trace, incrementing
+// esm.panics{where=name}, and restarting fn with exponential backoff rather
+// than letting the panic crash the whole agent. fn is also restarted when
+// it returns an error. safeGo itself returns at once; the goroutine exits
+// once fn returns nil or a.shutdownCh closes.
+func (a *Agent) safeGo(name string, fn func() error) {
+	go func() {
+		backoff := time.Second
+		for {
+			if a.runRecovered(name, fn) {
+				return
+			}
+
+			select {
+			case <-time.After(backoff):
+			case <-a.shutdownCh:
+				return
+			}
+
+			backoff *= 2
+			if backoff > safeGoMaxBackoff {
+				backoff = safeGoMaxBackoff
+			}
+		}
+	}()
+}
+
+// runRecovered runs fn once, recovering a panic if it occurs. It returns
+// true if the goroutine should not be restarted: fn returned nil, or the
+// agent is shutting down.
+func (a *Agent) runRecovered(name string, fn func() error) (done bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.logger.Printf("[ERR] agent: panic in %s: %v\n%s", name, r, debug.Stack())
+			metrics.IncrCounterWithLabels([]string{"panics"}, 1, []metrics.Label{{Name: "where", Value: name}})
+			done = false
+		}
+	}()
+
+	select {
+	case <-a.shutdownCh:
+		return true
+	default:
+	}
+
+	err := fn()
+	if err != nil {
+		a.logger.Printf("[WARN] agent: %s exited with error: %v", name, err)
+		return false
+	}
+	return true
+}